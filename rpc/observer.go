@@ -15,44 +15,62 @@ import (
 //
 // TODO:
 // - support multiple subscriptions (funcs) for the same op hash
-// - support block subscriptions (to connect a BlockObserver for full blocks + reorgs)
-// - support AdressObserver with address subscription filter
 // - disable events/polling when no subscriber exists
-// - handle reorgs (inclusion may switch to a different block hash)
 
 type ObserverCallback func(tezos.BlockHash, int64, int, int, bool) bool
 
 type observerSubscription struct {
 	id      int
+	key     string
 	cb      ObserverCallback
 	oh      tezos.OpHash
 	matched bool
 }
 
 type Observer struct {
-	subs       map[int]*observerSubscription
-	watched    map[tezos.OpHash]int
-	recent     map[tezos.OpHash][3]int64
-	seq        int
-	once       sync.Once
-	mu         sync.Mutex
-	ctx        context.Context
-	cancel     context.CancelFunc
-	c          *Client
-	minDelay   time.Duration
-	bestHash   tezos.BlockHash
-	bestHeight int64
+	subs           map[int]*observerSubscription
+	watched        map[tezos.OpHash]int
+	store          ObserverStore
+	mempoolSubs    map[int]*mempoolSubscription
+	mempoolSeen    map[tezos.OpHash]MempoolPool
+	mempoolOrder   []tezos.OpHash
+	addressSubs    map[int]*addressSubscription
+	addressRing    []addressNotification
+	blockSubs      map[int]*blockSubscription
+	blockChain     map[int64]blockChainLink
+	confirmSubs    map[int]*confirmSubscription
+	confirmWatched map[tezos.OpHash]int
+	seq            int
+	once           sync.Once
+	mempoolOnce    sync.Once
+	mu             sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	c              *Client
+	minDelay       time.Duration
+	maxReorgDepth  int
+	bestHash       tezos.BlockHash
+	bestHeight     int64
 }
 
 func NewObserver() *Observer {
 	ctx, cancel := context.WithCancel(context.Background())
 	m := &Observer{
-		subs:     make(map[int]*observerSubscription),
-		watched:  make(map[tezos.OpHash]int),
-		recent:   make(map[tezos.OpHash][3]int64),
-		minDelay: tezos.DefaultParams.MinimalBlockDelay,
-		ctx:      ctx,
-		cancel:   cancel,
+		subs:           make(map[int]*observerSubscription),
+		watched:        make(map[tezos.OpHash]int),
+		store:          newMemObserverStore(),
+		mempoolSubs:    make(map[int]*mempoolSubscription),
+		mempoolSeen:    make(map[tezos.OpHash]MempoolPool),
+		mempoolOrder:   make([]tezos.OpHash, 0, mempoolSeenSize),
+		addressSubs:    make(map[int]*addressSubscription),
+		blockSubs:      make(map[int]*blockSubscription),
+		blockChain:     make(map[int64]blockChainLink),
+		confirmSubs:    make(map[int]*confirmSubscription),
+		confirmWatched: make(map[tezos.OpHash]int),
+		minDelay:       tezos.DefaultParams.MinimalBlockDelay,
+		maxReorgDepth:  defaultMaxReorgDepth,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 	return m
 }
@@ -62,44 +80,122 @@ func (m *Observer) WithDelay(minDelay time.Duration) *Observer {
 	return m
 }
 
+// WithMaxReorgDepth overrides how far back resolveHead walks to find a
+// common ancestor before falling back to a best-effort orphan sweep. It
+// bounds only the depth of a fork; catching up on blocks missed while the
+// process was down is not limited by it.
+func (m *Observer) WithMaxReorgDepth(depth int) *Observer {
+	m.maxReorgDepth = depth
+	return m
+}
+
+// WithStore sets the persistence backend used for subscription intent, the
+// last processed head, and the short-lived recent-ops lookback. Must be
+// called before Listen. Defaults to an in-memory store, i.e. no durability
+// across restarts.
+func (m *Observer) WithStore(store ObserverStore) *Observer {
+	m.store = store
+	return m
+}
+
 func (m *Observer) Close() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.cancel()
 	m.subs = make(map[int]*observerSubscription)
 	m.watched = make(map[tezos.OpHash]int)
-	m.recent = make(map[tezos.OpHash][3]int64)
+	m.mempoolSubs = make(map[int]*mempoolSubscription)
+	m.mempoolSeen = make(map[tezos.OpHash]MempoolPool)
+	m.mempoolOrder = nil
+	m.addressSubs = make(map[int]*addressSubscription)
+	m.addressRing = nil
+	m.blockSubs = make(map[int]*blockSubscription)
+	m.blockChain = make(map[int64]blockChainLink)
+	m.confirmSubs = make(map[int]*confirmSubscription)
+	m.confirmWatched = make(map[tezos.OpHash]int)
 }
 
-func (m *Observer) Subscribe(oh tezos.OpHash, cb ObserverCallback) int {
+// Subscribe registers cb for oh under the stable key. The key survives
+// process restarts in whatever ObserverStore the Observer was built with:
+// after a restart, call PendingSubscriptions to find keys left over from
+// before, then Subscribe again with the same key and op hash to reattach a
+// callback. A match still held in the store's recent-ops lookback (see
+// ObserverStore.LookupRecent) is replayed immediately; matches from blocks
+// that have already left the lookback are not replayed.
+func (m *Observer) Subscribe(key string, oh tezos.OpHash, cb ObserverCallback) int {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	m.seq++
 	seq := m.seq
-	m.subs[seq] = &observerSubscription{
-		id: seq,
-		cb: cb,
-		oh: oh,
+	sub := &observerSubscription{
+		id:  seq,
+		key: key,
+		cb:  cb,
+		oh:  oh,
 	}
+	m.subs[seq] = sub
 	m.watched[oh] = seq
-	log.Debugf("monitor: %03d subscribed %s", seq, oh)
-	if pos, ok := m.recent[oh]; ok {
-		match := m.subs[seq]
-		if remove := match.cb(m.bestHash, pos[0], int(pos[1]), int(pos[2]), false); remove {
-			delete(m.subs, match.id)
+	m.mu.Unlock()
+
+	if err := m.store.SaveSub(key, oh); err != nil {
+		log.Warnf("monitor: cannot persist subscription %s: %v", key, err)
+	}
+	log.Debugf("monitor: %03d subscribed %s (key=%s)", seq, oh, key)
+
+	if block, height, opIdx, contentIdx, ok, err := m.store.LookupRecent(oh); err == nil && ok {
+		if remove := cb(block, height, opIdx, contentIdx, false); remove {
+			m.Unsubscribe(seq)
 		}
 	}
 	return seq
 }
 
+// PendingSubscriptions returns subscription keys and op hashes persisted by
+// the store but not yet reattached to a callback in this process, e.g.
+// after a restart.
+func (m *Observer) PendingSubscriptions() (map[string]tezos.OpHash, error) {
+	subs, err := m.store.LoadSubs()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	for _, sub := range m.subs {
+		delete(subs, sub.key)
+	}
+	m.mu.Unlock()
+	return subs, nil
+}
+
 func (m *Observer) Unsubscribe(id int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	req, ok := m.subs[id]
-	if ok {
+	if req, ok := m.subs[id]; ok {
 		delete(m.watched, req.oh)
 		delete(m.subs, id)
+		if err := m.store.DeleteSub(req.key); err != nil {
+			log.Warnf("monitor: cannot delete persisted subscription %s: %v", req.key, err)
+		}
 		log.Debugf("monitor: %03d unsubscribed %s", id, req.oh)
+		return
+	}
+	if _, ok := m.mempoolSubs[id]; ok {
+		delete(m.mempoolSubs, id)
+		log.Debugf("monitor: %03d unsubscribed from mempool", id)
+		return
+	}
+	if _, ok := m.addressSubs[id]; ok {
+		delete(m.addressSubs, id)
+		log.Debugf("monitor: %03d unsubscribed from address", id)
+		return
+	}
+	if _, ok := m.blockSubs[id]; ok {
+		delete(m.blockSubs, id)
+		log.Debugf("monitor: %03d unsubscribed from blocks", id)
+		return
+	}
+	if req, ok := m.confirmSubs[id]; ok {
+		delete(m.confirmWatched, req.oh)
+		delete(m.confirmSubs, id)
+		log.Debugf("monitor: %03d unsubscribed from confirmations", id)
 	}
 }
 
@@ -109,12 +205,33 @@ func (m *Observer) Listen(cli *Client) {
 		if m.c.Params != nil {
 			m.minDelay = m.c.Params.MinimalBlockDelay
 		}
+		m.restoreHead()
 		go m.listenBlocks()
 	})
 }
 
+// restoreHead loads the last head persisted by the store (if any) so
+// listenBlocks treats it as the previously seen best block. This makes the
+// existing gap-backfill logic in resolveHead replay every block since the
+// process went away before live monitoring resumes.
+func (m *Observer) restoreHead() {
+	hash, height, err := m.store.GetHead()
+	if err != nil {
+		log.Warnf("monitor: cannot load persisted head: %v", err)
+		return
+	}
+	if hash.IsZero() {
+		return
+	}
+	m.mu.Lock()
+	m.bestHash = hash
+	m.bestHeight = height
+	m.mu.Unlock()
+	log.Debugf("monitor: resuming from persisted head %d %s", height, hash)
+}
+
 func (m *Observer) ListenMempool(cli *Client) {
-	m.once.Do(func() {
+	m.mempoolOnce.Do(func() {
 		m.c = cli
 		if m.c.Params != nil {
 			m.minDelay = m.c.Params.MinimalBlockDelay
@@ -123,10 +240,6 @@ func (m *Observer) ListenMempool(cli *Client) {
 	})
 }
 
-func (m *Observer) listenMempool() {
-	// TODO
-}
-
 func (m *Observer) listenBlocks() {
 	var (
 		mon *BlockHeaderMonitor
@@ -172,6 +285,7 @@ func (m *Observer) listenBlocks() {
 		var (
 			headBlock  tezos.BlockHash
 			headHeight int64
+			headPred   tezos.BlockHash
 		)
 		if mon != nil && useEvents && !firstLoop {
 			// event mode: wait for next block message
@@ -185,6 +299,7 @@ func (m *Observer) listenBlocks() {
 			log.Debugf("monitor: new head %s", head.Hash)
 			headBlock = head.Hash.Clone()
 			headHeight = head.Level
+			headPred = head.Predecessor.Clone()
 		} else {
 			// poll mode: check every 30sec
 			head, err := m.c.GetTipHeader(m.ctx)
@@ -198,6 +313,7 @@ func (m *Observer) listenBlocks() {
 				continue
 			}
 			headHeight = head.Level
+			headPred = head.Predecessor.Clone()
 			headBlock, err = m.c.GetBlockHash(m.ctx, BlockLevel(head.Level))
 			if err != nil {
 				log.Debugf("monitor: cannot fetch block hash at height %d: %v", head.Level, err)
@@ -220,77 +336,101 @@ func (m *Observer) listenBlocks() {
 		}
 		log.Debugf("monitor: new block %d %s", headHeight, headBlock)
 
-		// TODO: check for reorg and gaps
+		// detect reorgs and gaps against the previously seen head, replay
+		// orphaned blocks (newest first), then process the canonical branch
+		// (oldest first) including headBlock itself
+		m.resolveHead(headBlock, headHeight, headPred)
 
-		// callback for all previous matches
-		m.mu.Lock()
-		for _, v := range m.subs {
-			if v.matched {
-				log.Debugf("monitor: signal n-th match for %d %s", v.id, v.oh)
-				if remove := v.cb(headBlock, -1, -1, -1, false); remove {
-					delete(m.subs, v.id)
-				}
+		// wait in poll mode
+		if !useEvents {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(m.minDelay):
 			}
 		}
-		m.mu.Unlock()
+	}
+}
 
-		// pull block ops and fan-out matches
-		ohs, err := m.c.GetBlockOperationHashes(m.ctx, headBlock)
-		if err != nil {
-			log.Warnf("monitor: cannot fetch block ops: %v", err)
-			continue
-		}
-		// clear recent op hashes
-		for n := range m.recent {
-			delete(m.recent, n)
+// processBlock fans out a single canonical block to op-hash subscribers,
+// n-th confirmation callbacks and address-scoped subscribers, then advances
+// the observer's notion of the best block.
+func (m *Observer) processBlock(headBlock tezos.BlockHash, headHeight int64) {
+	// callback for all previous matches
+	m.mu.Lock()
+	for _, v := range m.subs {
+		if v.matched {
+			log.Debugf("monitor: signal n-th match for %d %s", v.id, v.oh)
+			if remove := v.cb(headBlock, -1, -1, -1, false); remove {
+				delete(m.subs, v.id)
+			}
 		}
-		m.mu.Lock()
-		for l, list := range ohs {
-			for n, h := range list {
-				// keep as recent
-				m.recent[h] = [3]int64{headHeight, int64(l), int64(n)}
-
-				// match op hash against subs
-				id, ok := m.watched[h]
-				if !ok {
-					log.Debugf("monitor: --- !! %s", h)
-					continue
-				}
-				match, ok := m.subs[id]
-				if !ok {
-					log.Debugf("monitor: --- !! %s", h)
-					continue
-				}
+	}
+	m.mu.Unlock()
 
-				// cross check hash to guard against hash collisions
-				if !match.oh.Equal(h) {
-					log.Debugf("monitor: %03d != %s", id, h)
-					continue
-				}
+	// pull block ops and fan-out matches
+	ohs, err := m.c.GetBlockOperationHashes(m.ctx, headBlock)
+	if err != nil {
+		log.Warnf("monitor: cannot fetch block ops: %v", err)
+		return
+	}
 
-				log.Debugf("monitor: matched %d %s", match.id, match.oh)
+	m.mu.Lock()
+	for l, list := range ohs {
+		for n, h := range list {
+			// keep as recent, so a Subscribe racing this block still sees it
+			if err := m.store.RecordRecent(h, headBlock, headHeight, l, n); err != nil {
+				log.Debugf("monitor: cannot record recent op %s: %v", h, err)
+			}
 
-				// callback
-				if remove := match.cb(headBlock, headHeight, l, n, false); remove {
-					delete(m.subs, match.id)
+			// the op has left the mempool now that it's included, so stop
+			// tracking its pool classification
+			delete(m.mempoolSeen, h)
+
+			// match op hash against subs
+			if id, ok := m.watched[h]; ok {
+				if match, ok := m.subs[id]; ok && match.oh.Equal(h) {
+					log.Debugf("monitor: matched %d %s", match.id, match.oh)
+					if remove := match.cb(headBlock, headHeight, l, n, false); remove {
+						delete(m.subs, match.id)
+					} else {
+						match.matched = true
+					}
 				} else {
-					match.matched = true
+					log.Debugf("monitor: %03d != %s", id, h)
+				}
+			}
+
+			// match op hash against confirmation-tracking subs
+			if id, ok := m.confirmWatched[h]; ok {
+				if sub, ok := m.confirmSubs[id]; ok && sub.oh.Equal(h) && !sub.matched {
+					log.Debugf("monitor: %03d confirmation-tracking matched %s", sub.id, h)
+					sub.matched = true
+					sub.inclBlock = headBlock
+					sub.inclHeight = headHeight
 				}
 			}
 		}
+	}
 
-		// update monitor state
-		m.bestHash = headBlock
-		m.bestHeight = headHeight
-		m.mu.Unlock()
+	// update monitor state
+	m.bestHash = headBlock
+	m.bestHeight = headHeight
+	m.mu.Unlock()
 
-		// wait in poll mode
-		if !useEvents {
-			select {
-			case <-m.ctx.Done():
-				return
-			case <-time.After(m.minDelay):
-			}
+	if err := m.store.SetHead(headBlock, headHeight); err != nil {
+		log.Warnf("monitor: cannot persist head: %v", err)
+	}
+
+	// address-scoped subscriptions need full operation content, not
+	// just hashes, so only fetch it when someone is actually watching
+	if m.hasAddressSubs() {
+		if ops, err := m.c.GetBlockOperations(m.ctx, headBlock); err != nil {
+			log.Warnf("monitor: cannot fetch block operations: %v", err)
+		} else {
+			m.dispatchAddressOps(headBlock, headHeight, ops)
 		}
 	}
+
+	m.tickConfirmations(headBlock, headHeight)
 }
@@ -0,0 +1,203 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// addressRingSize bounds how many past address notifications are kept for
+// reorg replay. One block worth of matches is typically a handful of
+// entries, so this comfortably covers a multi-block reorg tail.
+const addressRingSize = 512
+
+// AddressWatchOptions controls which operations touching a watched address
+// are delivered to an AddressCallback.
+type AddressWatchOptions struct {
+	// IncludeInternal also matches internal operation results (e.g. a
+	// contract call that itself transfers to the watched address).
+	IncludeInternal bool
+	// Kinds restricts matches to the given operation kinds. An empty slice
+	// matches every kind.
+	Kinds []tezos.OpType
+}
+
+func (o AddressWatchOptions) allowsKind(k tezos.OpType) bool {
+	if len(o.Kinds) == 0 {
+		return true
+	}
+	for _, want := range o.Kinds {
+		if want == k {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressCallback receives every operation content or internal result that
+// touches a watched address. internalIdx is -1 for top-level contents. When
+// a previously delivered event is unwound by a reorg, the callback fires
+// again for the same (block, opIdx, contentIdx, internalIdx) with removed
+// set to true. Returning true cancels the subscription.
+type AddressCallback func(block tezos.BlockHash, height int64, opIdx, contentIdx, internalIdx int, removed bool) bool
+
+// InternalResult is the subset of a transaction/origination's internal
+// operation results needed for address matching.
+type InternalResult struct {
+	Kind        tezos.OpType
+	Source      tezos.Address
+	Destination tezos.Address
+}
+
+// internalResults returns the internal operation results produced by c, if
+// any. Only transactions and originations can trigger internal operations.
+func internalResults(c TypedOperation) []*InternalResult {
+	switch t := c.(type) {
+	case *Transaction:
+		return t.InternalResults
+	case *Origination:
+		return t.InternalResults
+	default:
+		return nil
+	}
+}
+
+type addressSubscription struct {
+	id   int
+	addr tezos.Address
+	opts AddressWatchOptions
+	cb   AddressCallback
+}
+
+// addressNotification records enough of a past delivery to replay it with
+// removed=true if the block that produced it gets orphaned.
+type addressNotification struct {
+	block       tezos.BlockHash
+	height      int64
+	opIdx       int
+	contentIdx  int
+	internalIdx int
+	subID       int
+}
+
+// SubscribeAddress registers cb to be called for every operation content
+// (and, if requested, internal result) that names addr as source,
+// destination or delegate.
+func (m *Observer) SubscribeAddress(addr tezos.Address, opts AddressWatchOptions, cb AddressCallback) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	seq := m.seq
+	m.addressSubs[seq] = &addressSubscription{
+		id:   seq,
+		addr: addr,
+		opts: opts,
+		cb:   cb,
+	}
+	log.Debugf("monitor: %03d subscribed address %s", seq, addr)
+	return seq
+}
+
+func (m *Observer) hasAddressSubs() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.addressSubs) > 0
+}
+
+// dispatchAddressOps walks a block's operations and notifies every address
+// subscription matched by source, destination or delegate, recording each
+// delivery in the replay ring.
+func (m *Observer) dispatchAddressOps(block tezos.BlockHash, height int64, ops [][]*Operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for opIdx, list := range ops {
+		for _, op := range list {
+			for contentIdx, c := range op.Contents {
+				m.matchAddressContent(block, height, opIdx, contentIdx, -1, c)
+				if !m.anyAddressWantsInternal() {
+					continue
+				}
+				for internalIdx, ir := range internalResults(c) {
+					m.matchAddressInternal(block, height, opIdx, contentIdx, internalIdx, ir)
+				}
+			}
+		}
+	}
+}
+
+func (m *Observer) anyAddressWantsInternal() bool {
+	for _, sub := range m.addressSubs {
+		if sub.opts.IncludeInternal {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Observer) matchAddressContent(block tezos.BlockHash, height int64, opIdx, contentIdx, internalIdx int, c TypedOperation) {
+	src, dst, _ := contentAddresses(c)
+	for id, sub := range m.addressSubs {
+		if !sub.opts.allowsKind(c.Kind()) {
+			continue
+		}
+		if !sub.addr.Equal(src) && !sub.addr.Equal(dst) {
+			continue
+		}
+		m.notifyAddress(id, sub, block, height, opIdx, contentIdx, internalIdx)
+	}
+}
+
+func (m *Observer) matchAddressInternal(block tezos.BlockHash, height int64, opIdx, contentIdx, internalIdx int, ir *InternalResult) {
+	for id, sub := range m.addressSubs {
+		if !sub.opts.IncludeInternal || !sub.opts.allowsKind(ir.Kind) {
+			continue
+		}
+		if !sub.addr.Equal(ir.Source) && !sub.addr.Equal(ir.Destination) {
+			continue
+		}
+		m.notifyAddress(id, sub, block, height, opIdx, contentIdx, internalIdx)
+	}
+}
+
+func (m *Observer) notifyAddress(id int, sub *addressSubscription, block tezos.BlockHash, height int64, opIdx, contentIdx, internalIdx int) {
+	log.Debugf("monitor: address %03d matched %s at %d/%d/%d", id, sub.addr, opIdx, contentIdx, internalIdx)
+	m.addressRing = append(m.addressRing, addressNotification{
+		block:       block,
+		height:      height,
+		opIdx:       opIdx,
+		contentIdx:  contentIdx,
+		internalIdx: internalIdx,
+		subID:       id,
+	})
+	if len(m.addressRing) > addressRingSize {
+		m.addressRing = m.addressRing[len(m.addressRing)-addressRingSize:]
+	}
+	if remove := sub.cb(block, height, opIdx, contentIdx, internalIdx, false); remove {
+		delete(m.addressSubs, id)
+	}
+}
+
+// replayOrphanedAddressEvents re-delivers every ring entry for orphaned with
+// removed=true, then drops them from the ring since the block no longer
+// exists on the canonical chain.
+func (m *Observer) replayOrphanedAddressEvents(orphaned tezos.BlockHash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.addressRing[:0]
+	for _, n := range m.addressRing {
+		if !n.block.Equal(orphaned) {
+			kept = append(kept, n)
+			continue
+		}
+		sub, ok := m.addressSubs[n.subID]
+		if !ok {
+			continue
+		}
+		log.Debugf("monitor: address %03d reorg-removed %s at %d/%d/%d", n.subID, n.block, n.opIdx, n.contentIdx, n.internalIdx)
+		if remove := sub.cb(n.block, n.height, n.opIdx, n.contentIdx, n.internalIdx, true); remove {
+			delete(m.addressSubs, n.subID)
+		}
+	}
+	m.addressRing = kept
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"fmt"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// defaultMaxReorgDepth caps how far back resolveHead walks to find a common
+// ancestor before giving up on an exact match and falling back to a
+// best-effort orphan sweep. Override with WithMaxReorgDepth to tolerate
+// deeper forks; catching up after downtime is not limited by it (see
+// findReorgBranch).
+const defaultMaxReorgDepth = 128
+
+// blockChainSize bounds the level -> (hash, predecessor) cache so ancestor
+// lookups during a reorg don't need an RPC round-trip in the common case.
+const blockChainSize = 4096
+
+// blockChainLink is what resolveHead remembers about a block it has already
+// seen, letting it walk predecessor pointers locally first.
+type blockChainLink struct {
+	hash        tezos.BlockHash
+	predecessor tezos.BlockHash
+}
+
+// chainBlock is a (height, hash) pair used while walking two candidate
+// chains back to their common ancestor.
+type chainBlock struct {
+	height int64
+	hash   tezos.BlockHash
+}
+
+// BlockEvent is delivered to a BlockObserverCallback for every block on the
+// canonical chain. Reverted is true when Block was previously delivered but
+// has since been orphaned by a reorg; such events fire newest-first, ahead
+// of the replacement branch.
+type BlockEvent struct {
+	Block    *Block
+	Reverted bool
+}
+
+// BlockObserverCallback receives full blocks in canonical order. Returning
+// true cancels the subscription.
+type BlockObserverCallback func(*BlockEvent) bool
+
+type blockSubscription struct {
+	id int
+	cb BlockObserverCallback
+}
+
+// SubscribeBlocks registers cb to be called with every new block on the
+// canonical chain, including replayed reverts and backfilled gaps.
+func (m *Observer) SubscribeBlocks(cb BlockObserverCallback) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	seq := m.seq
+	m.blockSubs[seq] = &blockSubscription{id: seq, cb: cb}
+	log.Debugf("monitor: %03d subscribed to blocks", seq)
+	return seq
+}
+
+func (m *Observer) rememberBlock(height int64, hash, predecessor tezos.BlockHash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blockChain[height] = blockChainLink{hash: hash, predecessor: predecessor}
+	if len(m.blockChain) <= blockChainSize {
+		return
+	}
+	var oldest int64 = -1
+	for h := range m.blockChain {
+		if oldest == -1 || h < oldest {
+			oldest = h
+		}
+	}
+	delete(m.blockChain, oldest)
+}
+
+// predecessorOf resolves the predecessor of (height, hash), preferring the
+// local cache and falling back to an RPC call on a miss.
+func (m *Observer) predecessorOf(height int64, hash tezos.BlockHash) (tezos.BlockHash, error) {
+	m.mu.Lock()
+	if link, ok := m.blockChain[height]; ok && link.hash.Equal(hash) {
+		m.mu.Unlock()
+		return link.predecessor, nil
+	}
+	m.mu.Unlock()
+	pred, err := m.c.GetBlockPredecessorHash(m.ctx, hash)
+	if err != nil {
+		return tezos.BlockHash{}, err
+	}
+	m.rememberBlock(height, hash, pred)
+	return pred, nil
+}
+
+// resolveHead advances the observer to (headBlock, headHeight), detecting
+// reorgs and gaps against the previously processed head. headPred is the
+// predecessor hash as delivered alongside headBlock by the monitor/poll
+// loop, if any; it lets the common case recognize a direct chain extension
+// without an extra RPC round-trip. Orphaned blocks are replayed
+// newest-first, then the canonical branch (including headBlock) is
+// processed oldest-first.
+func (m *Observer) resolveHead(headBlock tezos.BlockHash, headHeight int64, headPred tezos.BlockHash) {
+	m.mu.Lock()
+	prevHash, prevHeight := m.bestHash, m.bestHeight
+	m.mu.Unlock()
+
+	if prevHash.IsZero() {
+		m.rememberBlock(headHeight, headBlock, tezos.BlockHash{})
+		m.processBlock(headBlock, headHeight)
+		m.emitBlockEvent(headBlock, headHeight, false)
+		return
+	}
+
+	pred := headPred
+	var err error
+	if pred.IsZero() {
+		pred, err = m.predecessorOf(headHeight, headBlock)
+		if err != nil {
+			log.Warnf("monitor: cannot fetch predecessor of %s: %v", headBlock, err)
+		}
+	}
+	if !pred.IsZero() {
+		m.rememberBlock(headHeight, headBlock, pred)
+	}
+
+	// common case: headBlock directly extends the known best block
+	if headHeight == prevHeight+1 && pred.Equal(prevHash) {
+		m.processBlock(headBlock, headHeight)
+		m.emitBlockEvent(headBlock, headHeight, false)
+		return
+	}
+
+	orphaned, branch, err := m.findReorgBranch(prevHash, prevHeight, headBlock, headHeight)
+	if err != nil {
+		log.Warnf("monitor: could not resolve common ancestor, best-effort orphan sweep before resyncing from new head: %v", err)
+		// we couldn't prove which blocks were orphaned, but everything we
+		// still remember on the old best chain can no longer be canonical
+		// once headBlock has taken over, so replay removal for it rather
+		// than silently leaving address/confirmation subscribers with
+		// stale state
+		for _, o := range m.bestEffortOrphanSweep(prevHash, prevHeight) {
+			m.emitBlockEvent(o.hash, o.height, true)
+			m.replayOrphanedAddressEvents(o.hash)
+			m.resetConfirmedOnOrphan(o.hash)
+		}
+		m.processBlock(headBlock, headHeight)
+		m.emitBlockEvent(headBlock, headHeight, false)
+		return
+	}
+
+	// emit orphaned blocks newest first
+	for _, o := range orphaned {
+		m.emitBlockEvent(o.hash, o.height, true)
+		m.replayOrphanedAddressEvents(o.hash)
+		m.resetConfirmedOnOrphan(o.hash)
+	}
+
+	// process and emit the canonical branch oldest first, including headBlock
+	for _, b := range branch {
+		m.processBlock(b.hash, b.height)
+		m.emitBlockEvent(b.hash, b.height, false)
+	}
+}
+
+// findReorgBranch walks the old and new chains back in lockstep by height
+// until it finds a common ancestor, returning the orphaned blocks
+// (newest-first) and the replacement branch (oldest-first, including the
+// new head).
+//
+// The two chains are first caught up to the same height: this is a
+// straight-line walk down a single known chain, not an ancestor search, so
+// it isn't bounded by maxReorgDepth — a service restarting after a long
+// outage can legitimately need to backfill far more than maxReorgDepth
+// blocks even though nothing was ever orphaned. Only once both sides are at
+// the same height does a genuine common-ancestor search begin, and that
+// part is bounded by maxReorgDepth.
+func (m *Observer) findReorgBranch(oldHash tezos.BlockHash, oldHeight int64, newHash tezos.BlockHash, newHeight int64) (orphaned, branch []chainBlock, err error) {
+	oldCur := chainBlock{oldHeight, oldHash}
+	newCur := chainBlock{newHeight, newHash}
+	var newestFirst []chainBlock
+
+	for oldCur.height > newCur.height {
+		orphaned = append(orphaned, oldCur)
+		pred, err := m.predecessorOf(oldCur.height, oldCur.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		oldCur = chainBlock{oldCur.height - 1, pred}
+	}
+	for newCur.height > oldCur.height {
+		newestFirst = append(newestFirst, newCur)
+		pred, err := m.predecessorOf(newCur.height, newCur.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		newCur = chainBlock{newCur.height - 1, pred}
+	}
+
+	for steps := 0; ; steps++ {
+		if oldCur.hash.Equal(newCur.hash) {
+			break
+		}
+		if steps >= m.maxReorgDepth {
+			return nil, nil, fmt.Errorf("reorg deeper than %d blocks", m.maxReorgDepth)
+		}
+		orphaned = append(orphaned, oldCur)
+		newestFirst = append(newestFirst, newCur)
+		predOld, err := m.predecessorOf(oldCur.height, oldCur.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		predNew, err := m.predecessorOf(newCur.height, newCur.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		oldCur = chainBlock{oldCur.height - 1, predOld}
+		newCur = chainBlock{newCur.height - 1, predNew}
+	}
+
+	branch = make([]chainBlock, len(newestFirst))
+	for i, b := range newestFirst {
+		branch[len(newestFirst)-1-i] = b
+	}
+	return orphaned, branch, nil
+}
+
+// bestEffortOrphanSweep returns every block reachable from (height, hash) by
+// following predecessor links already cached in m.blockChain, newest first.
+// It's used when findReorgBranch gives up without proving a common ancestor:
+// those cached blocks were the old best chain, and since a new head has been
+// accepted in its place they can no longer be canonical, so they're reported
+// as orphaned on a best-effort basis even though the true fork point is
+// unknown. It makes no RPC calls, since the RPC is presumed to be the reason
+// the exact walk failed (or simply too far away to be worth retrying).
+func (m *Observer) bestEffortOrphanSweep(hash tezos.BlockHash, height int64) []chainBlock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var orphaned []chainBlock
+	cur := chainBlock{height, hash}
+	for {
+		link, ok := m.blockChain[cur.height]
+		if !ok || !link.hash.Equal(cur.hash) {
+			break
+		}
+		orphaned = append(orphaned, cur)
+		if link.predecessor.IsZero() {
+			break
+		}
+		cur = chainBlock{cur.height - 1, link.predecessor}
+	}
+	return orphaned
+}
+
+// emitBlockEvent fetches the full block at (height, hash) and fans it out
+// to block subscribers. It is also used to re-fetch orphaned blocks, which
+// is why it resolves by hash rather than by height.
+func (m *Observer) emitBlockEvent(hash tezos.BlockHash, height int64, reverted bool) {
+	m.mu.Lock()
+	hasSubs := len(m.blockSubs) > 0
+	m.mu.Unlock()
+	if !hasSubs {
+		return
+	}
+
+	block, err := m.c.GetBlockByHash(m.ctx, hash)
+	if err != nil {
+		log.Warnf("monitor: cannot fetch block %d %s for observers: %v", height, hash, err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, sub := range m.blockSubs {
+		if remove := sub.cb(&BlockEvent{Block: block, Reverted: reverted}); remove {
+			delete(m.blockSubs, id)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"testing"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// testBlockHash builds a deterministic, distinct BlockHash for test
+// fixtures. tag distinguishes same-height blocks on different branches.
+func testBlockHash(tag byte, height int64) tezos.BlockHash {
+	var h tezos.BlockHash
+	h[0] = tag
+	h[1] = byte(height)
+	h[2] = byte(height >> 8)
+	return h
+}
+
+// chainLink links a single block into m.blockChain so predecessorOf
+// resolves it from cache instead of needing an RPC client.
+func (m *Observer) chainLink(tag byte, height int64) {
+	pred := tezos.BlockHash{}
+	if height > 0 {
+		pred = testBlockHash(tag, height-1)
+	}
+	m.rememberBlock(height, testBlockHash(tag, height), pred)
+}
+
+func TestFindReorgBranchStraightGapIgnoresMaxDepth(t *testing.T) {
+	m := NewObserver().WithMaxReorgDepth(5)
+	for h := int64(0); h <= 50; h++ {
+		m.chainLink('A', h)
+	}
+
+	orphaned, branch, err := m.findReorgBranch(testBlockHash('A', 1), 1, testBlockHash('A', 50), 50)
+	if err != nil {
+		t.Fatalf("findReorgBranch: %v", err)
+	}
+	if len(orphaned) != 0 {
+		t.Fatalf("expected no orphaned blocks for a straight gap, got %d", len(orphaned))
+	}
+	if len(branch) != 49 {
+		t.Fatalf("expected 49 blocks backfilled (heights 2..50), got %d", len(branch))
+	}
+	for i, b := range branch {
+		wantHeight := int64(2 + i)
+		if b.height != wantHeight || !b.hash.Equal(testBlockHash('A', wantHeight)) {
+			t.Fatalf("branch[%d] = (%d, %s), want height %d", i, b.height, b.hash, wantHeight)
+		}
+	}
+}
+
+func TestFindReorgBranchWithinMaxDepth(t *testing.T) {
+	m := NewObserver().WithMaxReorgDepth(5)
+	// shared ancestry up to height 7
+	for h := int64(0); h <= 7; h++ {
+		m.chainLink('S', h)
+	}
+	// branch A and branch B both fork off height 7 and run to height 10
+	forkFrom := testBlockHash('S', 7)
+	for _, tag := range []byte{'A', 'B'} {
+		pred := forkFrom
+		for h := int64(8); h <= 10; h++ {
+			m.rememberBlock(h, testBlockHash(tag, h), pred)
+			pred = testBlockHash(tag, h)
+		}
+	}
+
+	orphaned, branch, err := m.findReorgBranch(testBlockHash('A', 10), 10, testBlockHash('B', 10), 10)
+	if err != nil {
+		t.Fatalf("findReorgBranch: %v", err)
+	}
+	if len(orphaned) != 3 || len(branch) != 3 {
+		t.Fatalf("expected 3 orphaned and 3 replacement blocks, got %d/%d", len(orphaned), len(branch))
+	}
+	// orphaned is newest-first
+	for i, wantHeight := range []int64{10, 9, 8} {
+		if orphaned[i].height != wantHeight || !orphaned[i].hash.Equal(testBlockHash('A', wantHeight)) {
+			t.Fatalf("orphaned[%d] = (%d, %s), want branch A height %d", i, orphaned[i].height, orphaned[i].hash, wantHeight)
+		}
+	}
+	// branch is oldest-first, including the new head
+	for i, wantHeight := range []int64{8, 9, 10} {
+		if branch[i].height != wantHeight || !branch[i].hash.Equal(testBlockHash('B', wantHeight)) {
+			t.Fatalf("branch[%d] = (%d, %s), want branch B height %d", i, branch[i].height, branch[i].hash, wantHeight)
+		}
+	}
+}
+
+func TestFindReorgBranchDeeperThanMaxDepthFails(t *testing.T) {
+	m := NewObserver().WithMaxReorgDepth(2)
+	for h := int64(0); h <= 2; h++ {
+		m.chainLink('S', h)
+	}
+	forkFrom := testBlockHash('S', 2)
+	for _, tag := range []byte{'A', 'B'} {
+		pred := forkFrom
+		for h := int64(3); h <= 10; h++ {
+			m.rememberBlock(h, testBlockHash(tag, h), pred)
+			pred = testBlockHash(tag, h)
+		}
+	}
+
+	_, _, err := m.findReorgBranch(testBlockHash('A', 10), 10, testBlockHash('B', 10), 10)
+	if err == nil {
+		t.Fatal("expected an error for a reorg deeper than maxReorgDepth, got nil")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// SubscribeOptions controls how a confirmation-aware subscription reports
+// progress after its operation is first included in a block.
+type SubscribeOptions struct {
+	// MinConfirmations fires the callback once the including block has
+	// reached this many confirmations. 0 or 1 fires on first inclusion.
+	MinConfirmations int
+	// UntilFinal additionally fires the callback once the including block
+	// reaches Tenderbake finality, regardless of MinConfirmations.
+	UntilFinal bool
+}
+
+// ConfirmedCallback reports confirmation-depth and finality progress for a
+// previously subscribed operation. block/height identify the block the op
+// was included in, confirmations counts blocks mined on top of it since
+// (1 at first inclusion), and final is true once that block is Tenderbake
+// final. If the including block is orphaned by a reorg before the requested
+// depth is reached, the callback fires once with removed=true and the
+// subscription's progress resets; it fires again from confirmations=1 if
+// the op reappears on the new branch. Returning true cancels the
+// subscription.
+type ConfirmedCallback func(block tezos.BlockHash, height int64, confirmations int, final bool, removed bool) bool
+
+type confirmSubscription struct {
+	id            int
+	oh            tezos.OpHash
+	opts          SubscribeOptions
+	cb            ConfirmedCallback
+	matched       bool
+	firedMin      bool
+	final         bool
+	inclBlock     tezos.BlockHash
+	inclHeight    int64
+	confirmations int
+}
+
+// SubscribeConfirmed registers cb to be notified as oh accumulates
+// confirmations (and, if requested, once it is finalized) rather than only
+// on first inclusion.
+func (m *Observer) SubscribeConfirmed(oh tezos.OpHash, opts SubscribeOptions, cb ConfirmedCallback) int {
+	m.mu.Lock()
+	m.seq++
+	seq := m.seq
+	sub := &confirmSubscription{
+		id:   seq,
+		oh:   oh,
+		opts: opts,
+		cb:   cb,
+	}
+	m.confirmSubs[seq] = sub
+	m.confirmWatched[oh] = seq
+	m.mu.Unlock()
+
+	log.Debugf("monitor: %03d subscribed to confirmations of %s", seq, oh)
+
+	// the op may already have been included in a block processed before
+	// this call landed (learn of inclusion, then ask for confirmation
+	// tracking is the natural order), so replay that match immediately
+	// the same way Subscribe does instead of waiting for a new block to
+	// re-observe the hash
+	if block, height, _, _, ok, err := m.store.LookupRecent(oh); err == nil && ok {
+		m.mu.Lock()
+		sub.matched = true
+		sub.inclBlock = block
+		sub.inclHeight = height
+		sub.confirmations = int(m.bestHeight-height) + 1
+		m.mu.Unlock()
+		m.fireConfirmProgress(sub)
+	}
+	return seq
+}
+
+// tickConfirmations advances every matched, not-yet-final confirmation
+// subscription against the new head, firing the min-confirmations and
+// finality milestones as they're reached.
+func (m *Observer) tickConfirmations(headBlock tezos.BlockHash, headHeight int64) {
+	m.mu.Lock()
+	due := make([]*confirmSubscription, 0)
+	for _, sub := range m.confirmSubs {
+		if !sub.matched || sub.final {
+			continue
+		}
+		sub.confirmations = int(headHeight-sub.inclHeight) + 1
+		due = append(due, sub)
+	}
+	m.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for _, sub := range due {
+		m.fireConfirmProgress(sub)
+	}
+}
+
+// fireConfirmProgress fires the min-confirmations and finality callbacks for
+// a matched subscription whose confirmations/inclBlock/inclHeight are
+// already current, shared by tickConfirmations and SubscribeConfirmed's
+// immediate replay of an already-included op (which can run concurrently
+// with tickConfirmations on the same subscription, so every read-modify-
+// write of firedMin/final stays under m.mu; only the callback itself runs
+// unlocked).
+func (m *Observer) fireConfirmProgress(sub *confirmSubscription) {
+	m.mu.Lock()
+	_, stillSubscribed := m.confirmSubs[sub.id]
+	if !stillSubscribed {
+		m.mu.Unlock()
+		return
+	}
+	minReached := sub.opts.MinConfirmations <= 1 || sub.confirmations >= sub.opts.MinConfirmations
+	fireMin := minReached && !sub.firedMin
+	if fireMin {
+		sub.firedMin = true
+	}
+	block, height, confirmations := sub.inclBlock, sub.inclHeight, sub.confirmations
+	m.mu.Unlock()
+
+	if fireMin {
+		if remove := sub.cb(block, height, confirmations, false, false); remove {
+			m.Unsubscribe(sub.id)
+			return
+		}
+	}
+
+	if !sub.opts.UntilFinal {
+		return
+	}
+	final, err := m.c.GetBlockMetadataIsFinal(m.ctx, BlockLevel(height))
+	if err != nil {
+		log.Debugf("monitor: %03d cannot check finality of %s: %v", sub.id, block, err)
+		return
+	}
+	if !final {
+		return
+	}
+
+	m.mu.Lock()
+	_, stillSubscribed = m.confirmSubs[sub.id]
+	if !stillSubscribed || sub.final {
+		m.mu.Unlock()
+		return
+	}
+	sub.final = true
+	m.mu.Unlock()
+
+	if remove := sub.cb(block, height, confirmations, true, false); remove {
+		m.Unsubscribe(sub.id)
+	}
+}
+
+// resetConfirmedOnOrphan fires removed=true for every confirmation
+// subscription whose inclusion block was just orphaned, then resets it so
+// the op can rematch on the replacement branch.
+func (m *Observer) resetConfirmedOnOrphan(orphaned tezos.BlockHash) {
+	m.mu.Lock()
+	affected := make([]*confirmSubscription, 0)
+	for _, sub := range m.confirmSubs {
+		if sub.matched && sub.inclBlock.Equal(orphaned) {
+			affected = append(affected, sub)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, sub := range affected {
+		log.Debugf("monitor: %03d confirmation-tracked op %s reorg-removed", sub.id, sub.oh)
+		remove := sub.cb(sub.inclBlock, sub.inclHeight, sub.confirmations, sub.final, true)
+		m.mu.Lock()
+		if remove {
+			delete(m.confirmWatched, sub.oh)
+			delete(m.confirmSubs, sub.id)
+		} else {
+			sub.matched = false
+			sub.firedMin = false
+			sub.final = false
+			sub.confirmations = 0
+			sub.inclBlock = tezos.BlockHash{}
+			sub.inclHeight = 0
+		}
+		m.mu.Unlock()
+	}
+}
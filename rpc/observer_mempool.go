@@ -0,0 +1,258 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// MempoolPool identifies which of the node's mempool classification buckets
+// an operation currently sits in. Operations can move between pools (e.g.
+// branch_delayed -> applied) as the mempool re-validates them against a
+// changing head.
+type MempoolPool byte
+
+const (
+	MempoolPoolApplied MempoolPool = iota
+	MempoolPoolRefused
+	MempoolPoolBranchRefused
+	MempoolPoolBranchDelayed
+	MempoolPoolOutdated
+	MempoolPoolUnprocessed
+)
+
+func (p MempoolPool) String() string {
+	switch p {
+	case MempoolPoolApplied:
+		return "applied"
+	case MempoolPoolRefused:
+		return "refused"
+	case MempoolPoolBranchRefused:
+		return "branch_refused"
+	case MempoolPoolBranchDelayed:
+		return "branch_delayed"
+	case MempoolPoolOutdated:
+		return "outdated"
+	case MempoolPoolUnprocessed:
+		return "unprocessed"
+	default:
+		return "invalid"
+	}
+}
+
+// MempoolFilter restricts a mempool subscription to operations matching all
+// of its non-zero fields (logical AND). Leave a field at its zero value to
+// match any operation on that dimension.
+type MempoolFilter struct {
+	Sender      tezos.Address // matches the operation's source
+	Receiver    tezos.Address // matches source or destination/delegate
+	Destination tezos.Address // matches a transaction's destination or an origination/delegation's delegate
+	Kind        tezos.OpType  // transaction, origination, delegation, reveal, ...
+	Entrypoint  string        // matches a transaction's entrypoint name
+}
+
+func (f MempoolFilter) isEmpty() bool {
+	return !f.Sender.IsValid() && !f.Receiver.IsValid() && !f.Destination.IsValid() &&
+		f.Kind == tezos.OpTypeInvalid && f.Entrypoint == ""
+}
+
+// matches reports whether any content of op satisfies the filter.
+func (f MempoolFilter) matches(op *Operation) bool {
+	if f.isEmpty() {
+		return true
+	}
+	for _, c := range op.Contents {
+		if f.Kind != tezos.OpTypeInvalid && c.Kind() != f.Kind {
+			continue
+		}
+		src, dst, entrypoint := contentAddresses(c)
+		if f.Sender.IsValid() && !f.Sender.Equal(src) {
+			continue
+		}
+		if f.Destination.IsValid() && !f.Destination.Equal(dst) {
+			continue
+		}
+		if f.Receiver.IsValid() && !f.Receiver.Equal(src) && !f.Receiver.Equal(dst) {
+			continue
+		}
+		if f.Entrypoint != "" && entrypoint != f.Entrypoint {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// contentAddresses extracts the source and destination-like addresses and
+// entrypoint (if any) from a single operation content so filters can match
+// across the different content kinds without a type switch at each callsite.
+func contentAddresses(c TypedOperation) (src, dst tezos.Address, entrypoint string) {
+	switch t := c.(type) {
+	case *Transaction:
+		src = t.Source
+		dst = t.Destination
+		if t.Parameters != nil {
+			entrypoint = t.Parameters.Entrypoint
+		}
+	case *Origination:
+		src = t.Source
+		if t.Delegate != nil {
+			dst = *t.Delegate
+		}
+	case *Delegation:
+		src = t.Source
+		if t.Delegate != nil {
+			dst = *t.Delegate
+		}
+	case *Reveal:
+		src = t.Source
+	}
+	return
+}
+
+// MempoolObserverCallback delivers a fully parsed operation as it enters (or
+// moves within) the node's mempool, together with the pool it currently
+// belongs to. Returning true cancels the subscription.
+type MempoolObserverCallback func(op *Operation, pool MempoolPool) bool
+
+// mempoolSeenSize bounds m.mempoolSeen for ops that are dropped from the
+// mempool without ever being included in a block (e.g. refused or
+// outdated), which would otherwise never be evicted by processBlock's
+// normal seen-in-a-block cleanup.
+const mempoolSeenSize = 16384
+
+type mempoolSubscription struct {
+	id     int
+	filter MempoolFilter
+	cb     MempoolObserverCallback
+}
+
+// SubscribeMempool registers cb to be called with every mempool operation
+// matching filter, tagged with its current pool classification. Use an
+// empty MempoolFilter{} to observe the full mempool.
+func (m *Observer) SubscribeMempool(filter MempoolFilter, cb MempoolObserverCallback) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	seq := m.seq
+	m.mempoolSubs[seq] = &mempoolSubscription{
+		id:     seq,
+		filter: filter,
+		cb:     cb,
+	}
+	log.Debugf("monitor: %03d subscribed to mempool", seq)
+	return seq
+}
+
+func (m *Observer) listenMempool() {
+	var (
+		mon       *MempoolMonitor
+		useEvents bool = true
+	)
+	defer func() {
+		if mon != nil {
+			mon.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		default:
+		}
+
+		if mon == nil && useEvents {
+			mon = NewMempoolMonitor()
+			if err := m.c.MonitorMempoolOperations(m.ctx, mon); err != nil {
+				mon.Close()
+				mon = nil
+				if ErrorStatus(err) == 404 {
+					log.Debug("monitor: mempool event mode unsupported, falling back to poll mode.")
+					useEvents = false
+				} else {
+					select {
+					case <-m.ctx.Done():
+						return
+					case <-time.After(5 * time.Second):
+					}
+				}
+				continue
+			}
+		}
+
+		var ops *MempoolOperations
+		if mon != nil && useEvents {
+			o, err := mon.Recv(m.ctx)
+			if err != nil {
+				mon.Close()
+				mon = nil
+				continue
+			}
+			ops = o
+		} else {
+			o, err := m.c.GetMempoolPendingOperations(m.ctx)
+			if err != nil {
+				select {
+				case <-m.ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+			ops = o
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+
+		m.dispatchMempoolOps(ops.Applied, MempoolPoolApplied)
+		m.dispatchMempoolOps(ops.Refused, MempoolPoolRefused)
+		m.dispatchMempoolOps(ops.BranchRefused, MempoolPoolBranchRefused)
+		m.dispatchMempoolOps(ops.BranchDelayed, MempoolPoolBranchDelayed)
+		m.dispatchMempoolOps(ops.Outdated, MempoolPoolOutdated)
+		m.dispatchMempoolOps(ops.Unprocessed, MempoolPoolUnprocessed)
+	}
+}
+
+// dispatchMempoolOps notifies matching subscribers of ops newly seen (or
+// reclassified into a different pool), then records their classification so
+// subsequent identical sightings are deduped across applied/refused/
+// branch_delayed/branch_refused/outdated pools. Entries are evicted once the
+// op is seen included in a processed block (see processBlock); ops that
+// leave the mempool without ever being included (e.g. refused) are instead
+// bounded by mempoolSeenSize, oldest first.
+func (m *Observer) dispatchMempoolOps(ops []*Operation, pool MempoolPool) {
+	if len(ops) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range ops {
+		if last, ok := m.mempoolSeen[op.Hash]; ok && last == pool {
+			continue
+		}
+		if _, ok := m.mempoolSeen[op.Hash]; !ok {
+			m.mempoolOrder = append(m.mempoolOrder, op.Hash)
+			for len(m.mempoolOrder) > mempoolSeenSize {
+				delete(m.mempoolSeen, m.mempoolOrder[0])
+				m.mempoolOrder = m.mempoolOrder[1:]
+			}
+		}
+		m.mempoolSeen[op.Hash] = pool
+		for id, sub := range m.mempoolSubs {
+			if !sub.filter.matches(op) {
+				continue
+			}
+			log.Debugf("monitor: mempool %03d matched %s (%s)", sub.id, op.Hash, pool)
+			if remove := sub.cb(op, pool); remove {
+				delete(m.mempoolSubs, id)
+			}
+		}
+	}
+}
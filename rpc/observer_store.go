@@ -0,0 +1,128 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"sync"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// ObserverStore persists the state rpc.Observer needs to survive a restart
+// without missing operations: which op hashes are being watched (under a
+// caller-chosen stable key), the last block it finished processing, and a
+// short lookback of recently seen ops for subscribers that race a block.
+//
+// Callback functions cannot be persisted. After a restart, callers list
+// their own previously saved keys (Observer.PendingSubscriptions) and call
+// Subscribe again with the same key and op hash; LookupRecent lets that call
+// replay a match that is still within the store's lookback window. Matches
+// that have already left that window are not kept and are not replayed.
+type ObserverStore interface {
+	// SaveSub persists that key is watching oh.
+	SaveSub(key string, oh tezos.OpHash) error
+	// DeleteSub removes a previously saved subscription.
+	DeleteSub(key string) error
+	// LoadSubs returns every currently saved key -> op hash pair.
+	LoadSubs() (map[string]tezos.OpHash, error)
+	// SetHead records the last block the observer finished processing.
+	SetHead(hash tezos.BlockHash, height int64) error
+	// GetHead returns the last recorded head, or a zero hash if none was
+	// ever saved.
+	GetHead() (tezos.BlockHash, int64, error)
+	// RecordRecent remembers that oh was seen at (block, height, opIdx,
+	// contentIdx), so a Subscribe call racing the block that included it
+	// still observes the match.
+	RecordRecent(oh tezos.OpHash, block tezos.BlockHash, height int64, opIdx, contentIdx int) error
+	// LookupRecent returns the position recorded by RecordRecent for oh, if
+	// still within the store's lookback window.
+	LookupRecent(oh tezos.OpHash) (block tezos.BlockHash, height int64, opIdx, contentIdx int, ok bool, err error)
+}
+
+// memObserverStore is the default ObserverStore: it keeps everything in
+// process memory, so it offers no durability across restarts but requires
+// no setup.
+type memObserverStore struct {
+	mu           sync.Mutex
+	subs         map[string]tezos.OpHash
+	head         tezos.BlockHash
+	height       int64
+	recentHeight int64
+	recent       map[tezos.OpHash]memRecentOp
+}
+
+// memRecentOp is the recorded position of a recently seen op, including the
+// block it was seen in.
+type memRecentOp struct {
+	block tezos.BlockHash
+	pos   [3]int64
+}
+
+func newMemObserverStore() *memObserverStore {
+	return &memObserverStore{
+		subs:   make(map[string]tezos.OpHash),
+		recent: make(map[tezos.OpHash]memRecentOp),
+	}
+}
+
+func (s *memObserverStore) SaveSub(key string, oh tezos.OpHash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[key] = oh
+	return nil
+}
+
+func (s *memObserverStore) DeleteSub(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, key)
+	return nil
+}
+
+func (s *memObserverStore) LoadSubs() (map[string]tezos.OpHash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]tezos.OpHash, len(s.subs))
+	for k, v := range s.subs {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *memObserverStore) SetHead(hash tezos.BlockHash, height int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.head = hash
+	s.height = height
+	return nil
+}
+
+func (s *memObserverStore) GetHead() (tezos.BlockHash, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.head, s.height, nil
+}
+
+func (s *memObserverStore) RecordRecent(oh tezos.OpHash, block tezos.BlockHash, height int64, opIdx, contentIdx int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the lookback only needs to cover the block currently being
+	// processed, so drop older entries once a newer block arrives
+	if height > s.recentHeight {
+		s.recent = make(map[tezos.OpHash]memRecentOp, len(s.recent))
+		s.recentHeight = height
+	}
+	s.recent[oh] = memRecentOp{block: block, pos: [3]int64{height, int64(opIdx), int64(contentIdx)}}
+	return nil
+}
+
+func (s *memObserverStore) LookupRecent(oh tezos.OpHash) (tezos.BlockHash, int64, int, int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.recent[oh]
+	if !ok {
+		return tezos.BlockHash{}, 0, 0, 0, false, nil
+	}
+	return rec.block, rec.pos[0], int(rec.pos[1]), int(rec.pos[2]), true, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+//go:build bolt
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"blockwatch.cc/tzgo/tezos"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucketSubs   = []byte("observer_subs")
+	boltBucketHead   = []byte("observer_head")
+	boltBucketRecent = []byte("observer_recent")
+	boltKeyHead      = []byte("head")
+)
+
+// BoltObserverStore persists Observer subscription state in a local BoltDB
+// file, so a restarted service resumes from where it left off instead of
+// starting from the live chain head.
+type BoltObserverStore struct {
+	db *bolt.DB
+}
+
+// NewBoltObserverStore opens (creating if necessary) a BoltDB file at path
+// and prepares it for use as an ObserverStore.
+func NewBoltObserverStore(path string) (*BoltObserverStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("observer: opening bolt store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltBucketSubs, boltBucketHead, boltBucketRecent} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("observer: initializing bolt store: %w", err)
+	}
+	return &BoltObserverStore{db: db}, nil
+}
+
+// Close releases the underlying BoltDB file handle.
+func (s *BoltObserverStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltObserverStore) SaveSub(key string, oh tezos.OpHash) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketSubs).Put([]byte(key), []byte(oh.String()))
+	})
+}
+
+func (s *BoltObserverStore) DeleteSub(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketSubs).Delete([]byte(key))
+	})
+}
+
+func (s *BoltObserverStore) LoadSubs() (map[string]tezos.OpHash, error) {
+	out := make(map[string]tezos.OpHash)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketSubs).ForEach(func(k, v []byte) error {
+			oh, err := tezos.ParseOpHash(string(v))
+			if err != nil {
+				return fmt.Errorf("observer: decoding stored op hash for %q: %w", k, err)
+			}
+			out[string(k)] = oh
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type boltHeadRecord struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+}
+
+func (s *BoltObserverStore) SetHead(hash tezos.BlockHash, height int64) error {
+	buf, err := json.Marshal(boltHeadRecord{Hash: hash.String(), Height: height})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketHead).Put(boltKeyHead, buf)
+	})
+}
+
+func (s *BoltObserverStore) GetHead() (tezos.BlockHash, int64, error) {
+	var rec boltHeadRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(boltBucketHead).Get(boltKeyHead)
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, &rec)
+	})
+	if err != nil || !found {
+		return tezos.BlockHash{}, 0, err
+	}
+	hash, err := tezos.ParseBlockHash(rec.Hash)
+	if err != nil {
+		return tezos.BlockHash{}, 0, fmt.Errorf("observer: decoding stored head: %w", err)
+	}
+	return hash, rec.Height, nil
+}
+
+type boltRecentRecord struct {
+	Block      string `json:"block"`
+	Height     int64  `json:"height"`
+	OpIdx      int    `json:"op_idx"`
+	ContentIdx int    `json:"content_idx"`
+}
+
+func (s *BoltObserverStore) RecordRecent(oh tezos.OpHash, block tezos.BlockHash, height int64, opIdx, contentIdx int) error {
+	buf, err := json.Marshal(boltRecentRecord{
+		Block:      block.String(),
+		Height:     height,
+		OpIdx:      opIdx,
+		ContentIdx: contentIdx,
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucketRecent)
+		// prune entries from older blocks so the bucket stays small
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var rec boltRecentRecord
+			if json.Unmarshal(v, &rec) == nil && rec.Height < height {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return b.Put([]byte(oh.String()), buf)
+	})
+}
+
+func (s *BoltObserverStore) LookupRecent(oh tezos.OpHash) (tezos.BlockHash, int64, int, int, bool, error) {
+	var rec boltRecentRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(boltBucketRecent).Get([]byte(oh.String()))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, &rec)
+	})
+	if err != nil || !found {
+		return tezos.BlockHash{}, 0, 0, 0, false, err
+	}
+	block, err := tezos.ParseBlockHash(rec.Block)
+	if err != nil {
+		return tezos.BlockHash{}, 0, 0, 0, false, fmt.Errorf("observer: decoding stored recent block: %w", err)
+	}
+	return block, rec.Height, rec.OpIdx, rec.ContentIdx, true, nil
+}
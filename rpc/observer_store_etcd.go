@@ -0,0 +1,163 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+//go:build etcd
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdObserverStore persists Observer subscription state in etcd, so
+// multiple replicas of a service can share (and fail over) the same
+// subscription and head state.
+type EtcdObserverStore struct {
+	cli     *clientv3.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// NewEtcdObserverStore builds an ObserverStore backed by cli, namespacing
+// all keys under prefix (e.g. "/myservice/observer/").
+func NewEtcdObserverStore(cli *clientv3.Client, prefix string) *EtcdObserverStore {
+	return &EtcdObserverStore{cli: cli, prefix: prefix, timeout: 5 * time.Second}
+}
+
+func (s *EtcdObserverStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *EtcdObserverStore) subKey(key string) string {
+	return s.prefix + "subs/" + key
+}
+
+func (s *EtcdObserverStore) SaveSub(key string, oh tezos.OpHash) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.cli.Put(ctx, s.subKey(key), oh.String())
+	return err
+}
+
+func (s *EtcdObserverStore) DeleteSub(key string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.cli.Delete(ctx, s.subKey(key))
+	return err
+}
+
+func (s *EtcdObserverStore) LoadSubs() (map[string]tezos.OpHash, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	resp, err := s.cli.Get(ctx, s.prefix+"subs/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	prefixLen := len(s.prefix + "subs/")
+	out := make(map[string]tezos.OpHash, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		oh, err := tezos.ParseOpHash(string(kv.Value))
+		if err != nil {
+			return nil, fmt.Errorf("observer: decoding stored op hash for %q: %w", kv.Key, err)
+		}
+		out[string(kv.Key)[prefixLen:]] = oh
+	}
+	return out, nil
+}
+
+type etcdHeadRecord struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+}
+
+func (s *EtcdObserverStore) SetHead(hash tezos.BlockHash, height int64) error {
+	buf, err := json.Marshal(etcdHeadRecord{Hash: hash.String(), Height: height})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err = s.cli.Put(ctx, s.prefix+"head", string(buf))
+	return err
+}
+
+func (s *EtcdObserverStore) GetHead() (tezos.BlockHash, int64, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	resp, err := s.cli.Get(ctx, s.prefix+"head")
+	if err != nil {
+		return tezos.BlockHash{}, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return tezos.BlockHash{}, 0, nil
+	}
+	var rec etcdHeadRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+		return tezos.BlockHash{}, 0, fmt.Errorf("observer: decoding stored head: %w", err)
+	}
+	hash, err := tezos.ParseBlockHash(rec.Hash)
+	if err != nil {
+		return tezos.BlockHash{}, 0, fmt.Errorf("observer: decoding stored head: %w", err)
+	}
+	return hash, rec.Height, nil
+}
+
+type etcdRecentRecord struct {
+	Block      string `json:"block"`
+	Height     int64  `json:"height"`
+	OpIdx      int    `json:"op_idx"`
+	ContentIdx int    `json:"content_idx"`
+}
+
+func (s *EtcdObserverStore) recentKey(oh tezos.OpHash) string {
+	return s.prefix + "recent/" + oh.String()
+}
+
+func (s *EtcdObserverStore) RecordRecent(oh tezos.OpHash, block tezos.BlockHash, height int64, opIdx, contentIdx int) error {
+	buf, err := json.Marshal(etcdRecentRecord{
+		Block:      block.String(),
+		Height:     height,
+		OpIdx:      opIdx,
+		ContentIdx: contentIdx,
+	})
+	if err != nil {
+		return err
+	}
+	// let the recent lookback expire on its own instead of tracking and
+	// deleting older entries across a distributed store
+	lease, err := s.cli.Grant(context.Background(), 60)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err = s.cli.Put(ctx, s.recentKey(oh), string(buf), clientv3.WithLease(lease.ID))
+	return err
+}
+
+func (s *EtcdObserverStore) LookupRecent(oh tezos.OpHash) (tezos.BlockHash, int64, int, int, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	resp, err := s.cli.Get(ctx, s.recentKey(oh))
+	if err != nil {
+		return tezos.BlockHash{}, 0, 0, 0, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return tezos.BlockHash{}, 0, 0, 0, false, nil
+	}
+	var rec etcdRecentRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+		return tezos.BlockHash{}, 0, 0, 0, false, fmt.Errorf("observer: decoding stored recent op: %w", err)
+	}
+	block, err := tezos.ParseBlockHash(rec.Block)
+	if err != nil {
+		return tezos.BlockHash{}, 0, 0, 0, false, fmt.Errorf("observer: decoding stored recent op: %w", err)
+	}
+	return block, rec.Height, rec.OpIdx, rec.ContentIdx, true, nil
+}
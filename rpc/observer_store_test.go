@@ -0,0 +1,98 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"testing"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+func TestMemObserverStoreSubs(t *testing.T) {
+	s := newMemObserverStore()
+	oh := testOpHash(1)
+
+	if err := s.SaveSub("key1", oh); err != nil {
+		t.Fatalf("SaveSub: %v", err)
+	}
+	subs, err := s.LoadSubs()
+	if err != nil {
+		t.Fatalf("LoadSubs: %v", err)
+	}
+	if got, ok := subs["key1"]; !ok || !got.Equal(oh) {
+		t.Fatalf("LoadSubs = %v, want key1 -> %s", subs, oh)
+	}
+
+	if err := s.DeleteSub("key1"); err != nil {
+		t.Fatalf("DeleteSub: %v", err)
+	}
+	subs, err = s.LoadSubs()
+	if err != nil {
+		t.Fatalf("LoadSubs: %v", err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("LoadSubs after delete = %v, want empty", subs)
+	}
+}
+
+func TestMemObserverStoreHead(t *testing.T) {
+	s := newMemObserverStore()
+	hash, height, err := s.GetHead()
+	if err != nil {
+		t.Fatalf("GetHead: %v", err)
+	}
+	if !hash.Equal(tezos.BlockHash{}) || height != 0 {
+		t.Fatalf("GetHead before any write = (%s, %d), want zero value", hash, height)
+	}
+
+	want := testBlockHash('H', 42)
+	if err := s.SetHead(want, 42); err != nil {
+		t.Fatalf("SetHead: %v", err)
+	}
+	hash, height, err = s.GetHead()
+	if err != nil {
+		t.Fatalf("GetHead: %v", err)
+	}
+	if !hash.Equal(want) || height != 42 {
+		t.Fatalf("GetHead = (%s, %d), want (%s, 42)", hash, height, want)
+	}
+}
+
+func TestMemObserverStoreRecentPrunesOlderHeights(t *testing.T) {
+	s := newMemObserverStore()
+	oh1, oh2 := testOpHash(1), testOpHash(2)
+	block10 := testBlockHash('R', 10)
+	block11 := testBlockHash('R', 11)
+
+	if err := s.RecordRecent(oh1, block10, 10, 0, 0); err != nil {
+		t.Fatalf("RecordRecent: %v", err)
+	}
+	if _, _, _, _, ok, err := s.LookupRecent(oh1); err != nil || !ok {
+		t.Fatalf("LookupRecent(oh1) after height 10 = ok=%v err=%v, want ok=true", ok, err)
+	}
+
+	// a later block arriving drops the lookback for the previous height,
+	// since a Subscribe racing a now-processed block only ever needs to
+	// see the block currently being processed
+	if err := s.RecordRecent(oh2, block11, 11, 1, 0); err != nil {
+		t.Fatalf("RecordRecent: %v", err)
+	}
+	if _, _, _, _, ok, err := s.LookupRecent(oh1); err != nil || ok {
+		t.Fatalf("LookupRecent(oh1) after height 11 = ok=%v err=%v, want ok=false", ok, err)
+	}
+	block, height, opIdx, contentIdx, ok, err := s.LookupRecent(oh2)
+	if err != nil || !ok {
+		t.Fatalf("LookupRecent(oh2) = ok=%v err=%v, want ok=true", ok, err)
+	}
+	if !block.Equal(block11) || height != 11 || opIdx != 1 || contentIdx != 0 {
+		t.Fatalf("LookupRecent(oh2) = (%s, %d, %d, %d), want (%s, 11, 1, 0)", block, height, opIdx, contentIdx, block11)
+	}
+}
+
+// testOpHash builds a deterministic, distinct OpHash for test fixtures.
+func testOpHash(tag byte) tezos.OpHash {
+	var h tezos.OpHash
+	h[0] = tag
+	return h
+}